@@ -0,0 +1,188 @@
+package utils
+
+/*
+	Copyright (C) 2015  Wolfgang Meyers
+
+    This program is free software; you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation; either version 2 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License along
+    with this program; if not, write to the Free Software Foundation, Inc.,
+    51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// File is the subset of afero.File this package needs: enough to back a
+// FilePart without copying it into memory up front.
+type File interface {
+	io.ReadCloser
+	io.ReaderAt
+	Stat() (os.FileInfo, error)
+}
+
+// Fs is a minimal filesystem abstraction, the subset of afero.Fs this
+// module needs, so a WARC's source isn't hard-coded to an io.Reader from
+// os.Open. OsFs, MemFs and TarFs are the built-in implementations.
+// NewFilePartFromFs is the one place that takes an Fs: it builds a FilePart
+// over a file opened from any of them. No other reader in the module
+// accepts an Fs.
+type Fs interface {
+	Open(name string) (File, error)
+}
+
+// NewFilePartFromFs opens name on fsys at [off, off+length) and wraps it
+// in a FilePart via NewFilePartAt. The opened File is closed when the
+// returned FilePart is closed.
+func NewFilePartFromFs(fsys Fs, name string, off, length int64) (*FilePart, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fp := NewFilePartAt(f, off, length)
+	fp.closer = f
+	return fp, nil
+}
+
+// OsFs is the Fs implementation backed by the local disk. *os.File already
+// satisfies File, so Open needs no wrapping.
+type OsFs struct{}
+
+func (OsFs) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+// MemFs is an in-memory Fs, for tests, that satisfies the same Fs
+// interface the other backends use. NewFilePart does not use it; it keeps
+// its own in-memory copy of the record.
+type MemFs struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// NewMemFs creates an empty MemFs.
+func NewMemFs() *MemFs {
+	return &MemFs{files: map[string][]byte{}}
+}
+
+// WriteFile stores data under name, overwriting any previous contents.
+func (fs *MemFs) WriteFile(name string, data []byte) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.files[name] = data
+}
+
+func (fs *MemFs) Open(name string) (File, error) {
+	fs.mu.Lock()
+	data, ok := fs.files[name]
+	fs.mu.Unlock()
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return &memFile{name: name, r: bytes.NewReader(data), size: int64(len(data))}, nil
+}
+
+type memFile struct {
+	name string
+	r    *bytes.Reader
+	size int64
+}
+
+func (f *memFile) Read(p []byte) (int, error)             { return f.r.Read(p) }
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) { return f.r.ReadAt(p, off) }
+func (f *memFile) Close() error                            { return nil }
+func (f *memFile) Stat() (os.FileInfo, error)              { return memFileInfo{f.name, f.size}, nil }
+
+type memFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() os.FileMode  { return 0444 }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+// TarFs exposes the members of a tar archive as files, so a .warc living
+// inside a .tar can be iterated without extracting it to disk first.
+type TarFs struct {
+	ra      io.ReaderAt
+	entries map[string]tarEntry
+}
+
+type tarEntry struct {
+	offset int64
+	size   int64
+	info   os.FileInfo
+}
+
+// countingReader tracks how many bytes have been read from r, so NewTarFs
+// can record each entry's data offset without re-deriving tar block/
+// padding arithmetic by hand.
+type countingReader struct {
+	r   io.Reader
+	pos int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.pos += int64(n)
+	return n, err
+}
+
+// NewTarFs scans the tar archive backed by ra (typically an *os.File) and
+// indexes its entries by name so they can be opened at random via Open.
+func NewTarFs(ra io.ReaderAt) (*TarFs, error) {
+	cr := &countingReader{r: io.NewSectionReader(ra, 0, math.MaxInt64)}
+	tr := tar.NewReader(cr)
+	fsys := &TarFs{ra: ra, entries: map[string]tarEntry{}}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		fsys.entries[hdr.Name] = tarEntry{
+			offset: cr.pos,
+			size:   hdr.Size,
+			info:   hdr.FileInfo(),
+		}
+	}
+	return fsys, nil
+}
+
+func (fsys *TarFs) Open(name string) (File, error) {
+	e, ok := fsys.entries[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return &tarFile{section: io.NewSectionReader(fsys.ra, e.offset, e.size), info: e.info}, nil
+}
+
+type tarFile struct {
+	section *io.SectionReader
+	info    os.FileInfo
+}
+
+func (f *tarFile) Read(p []byte) (int, error)             { return f.section.Read(p) }
+func (f *tarFile) ReadAt(p []byte, off int64) (int, error) { return f.section.ReadAt(p, off) }
+func (f *tarFile) Close() error                            { return nil }
+func (f *tarFile) Stat() (os.FileInfo, error)              { return f.info, nil }
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestMemFsRoundTrip(t *testing.T) {
+	contents := []byte("hello world")
+	fsys := NewMemFs()
+	fsys.WriteFile("a.warc", contents)
+
+	fp, err := NewFilePartFromFs(fsys, "a.warc", 0, int64(len(contents)))
+	if err != nil {
+		t.Fatalf("NewFilePartFromFs: %v", err)
+	}
+	defer fp.Close()
+
+	got, err := io.ReadAll(fp)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != string(contents) {
+		t.Fatalf("got %q, want %q", got, contents)
+	}
+}
+
+func TestMemFsOpenMissingFile(t *testing.T) {
+	fsys := NewMemFs()
+	if _, err := fsys.Open("missing.warc"); err == nil {
+		t.Fatal("expected an error opening a file that was never written")
+	}
+}
+
+func TestTarFsRoundTrip(t *testing.T) {
+	contents := []byte("record contents")
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{
+		Name: "collection/foo.warc",
+		Size: int64(len(contents)),
+		Mode: 0644,
+	}); err != nil {
+		t.Fatalf("WriteHeader: %v", err)
+	}
+	if _, err := tw.Write(contents); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	fsys, err := NewTarFs(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("NewTarFs: %v", err)
+	}
+
+	fp, err := NewFilePartFromFs(fsys, "collection/foo.warc", 0, int64(len(contents)))
+	if err != nil {
+		t.Fatalf("NewFilePartFromFs: %v", err)
+	}
+	defer fp.Close()
+
+	got, err := io.ReadAll(fp)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != string(contents) {
+		t.Fatalf("got %q, want %q", got, contents)
+	}
+}
@@ -0,0 +1,160 @@
+package utils
+
+/*
+	Copyright (C) 2015  Wolfgang Meyers
+
+    This program is free software; you can redistribute it and/or modify
+    it under the terms of the GNU General Public License as published by
+    the Free Software Foundation; either version 2 of the License, or
+    (at your option) any later version.
+
+    This program is distributed in the hope that it will be useful,
+    but WITHOUT ANY WARRANTY; without even the implied warranty of
+    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+    GNU General Public License for more details.
+
+    You should have received a copy of the GNU General Public License along
+    with this program; if not, write to the Free Software Foundation, Inc.,
+    51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TokenBucket is a minimal token-bucket rate limiter. It is safe for
+// concurrent use, so a single TokenBucket can be shared by several
+// RateLimitedReaders (e.g. many FileParts in a crawl-replay worker) to
+// enforce one global throughput cap instead of a cap per reader.
+type TokenBucket struct {
+	mu         sync.Mutex
+	rate       float64 // bytes per second; <= 0 means unlimited
+	burst      float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+// NewTokenBucket creates a TokenBucket allowing bytesPerSec bytes/sec of
+// sustained throughput with a burst of up to burst bytes. A bytesPerSec of
+// 0 disables throttling.
+func NewTokenBucket(bytesPerSec, burst int) *TokenBucket {
+	return &TokenBucket{
+		rate:       float64(bytesPerSec),
+		burst:      float64(burst),
+		tokens:     float64(burst),
+		lastRefill: time.Now(),
+	}
+}
+
+// WaitN blocks until n tokens (bytes) are available, or ctx is done. n may
+// exceed the bucket's burst size (e.g. a caller reading through a stock
+// bufio/io.Copy-sized buffer against a deliberately small burst): refill
+// caps tokens at burst, so WaitN splits n into burst-sized pieces
+// internally rather than waiting for a token count it can never reach.
+func (tb *TokenBucket) WaitN(ctx context.Context, n int) error {
+	if tb.rate <= 0 {
+		return nil
+	}
+	for n > 0 {
+		take := n
+		if max := int(tb.burst); max > 0 && take > max {
+			take = max
+		}
+		if err := tb.waitChunk(ctx, take); err != nil {
+			return err
+		}
+		n -= take
+	}
+	return nil
+}
+
+// waitChunk blocks until take tokens are available. take must not exceed
+// the bucket's burst size, or it can never be satisfied.
+func (tb *TokenBucket) waitChunk(ctx context.Context, take int) error {
+	for {
+		tb.mu.Lock()
+		tb.refill()
+		if tb.tokens >= float64(take) {
+			tb.tokens -= float64(take)
+			tb.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((float64(take) - tb.tokens) / tb.rate * float64(time.Second))
+		tb.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// refill tops up the bucket based on elapsed time since the last refill.
+// Callers must hold tb.mu.
+func (tb *TokenBucket) refill() {
+	now := time.Now()
+	tb.tokens += now.Sub(tb.lastRefill).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.lastRefill = now
+}
+
+// RateLimitedReader wraps an io.Reader (typically a FilePart) with a
+// token-bucket limiter, so callers replaying WARCs into a downstream
+// indexer, or streaming records over HTTP, can cap throughput per record
+// or per stream instead of relying on their own time.Sleep.
+type RateLimitedReader struct {
+	r         io.Reader
+	ctx       context.Context
+	bucket    *TokenBucket
+	bytesRead int64
+}
+
+// NewRateLimitedReader wraps r with a token bucket allowing bytesPerSec
+// bytes/sec of sustained throughput and a burst of up to burst bytes. A
+// nil ctx defaults to context.Background.
+func NewRateLimitedReader(ctx context.Context, r io.Reader, bytesPerSec, burst int) *RateLimitedReader {
+	return NewSharedRateLimitedReader(ctx, r, NewTokenBucket(bytesPerSec, burst))
+}
+
+// NewSharedRateLimitedReader wraps r with an existing TokenBucket, so
+// several readers can be throttled against one shared, global cap.
+func NewSharedRateLimitedReader(ctx context.Context, r io.Reader, bucket *TokenBucket) *RateLimitedReader {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &RateLimitedReader{r: r, ctx: ctx, bucket: bucket}
+}
+
+// NewRateLimitedFilePart wraps fp in a RateLimitedReader capped at
+// bytesPerSec bytes/sec with the given burst. A nil ctx defaults to
+// context.Background.
+func NewRateLimitedFilePart(ctx context.Context, fp *FilePart, bytesPerSec, burst int) *RateLimitedReader {
+	return NewRateLimitedReader(ctx, fp, bytesPerSec, burst)
+}
+
+// Read implements io.Reader, blocking until the token bucket admits the
+// bytes r already returned.
+func (rr *RateLimitedReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if n > 0 {
+		atomic.AddInt64(&rr.bytesRead, int64(n))
+		if werr := rr.bucket.WaitN(rr.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// BytesRead returns the total number of bytes this reader has returned to
+// its caller, for accounting when several readers share one TokenBucket.
+func (rr *RateLimitedReader) BytesRead() int64 {
+	return atomic.LoadInt64(&rr.bytesRead)
+}
@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketWaitNLargerThanBurstDoesNotHang(t *testing.T) {
+	tb := NewTokenBucket(1000, 8)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := tb.WaitN(ctx, 64); err != nil {
+		t.Fatalf("WaitN: %v", err)
+	}
+}
+
+func TestRateLimitedReaderHandlesBufferLargerThanBurst(t *testing.T) {
+	data := bytes.Repeat([]byte("y"), 4096)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rr := NewRateLimitedReader(ctx, bytes.NewReader(data), 1<<20, 500)
+	got, err := io.ReadAll(rr)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if len(got) != len(data) {
+		t.Fatalf("expected %d bytes, got %d", len(data), len(got))
+	}
+}
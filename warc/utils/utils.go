@@ -20,9 +20,10 @@ package utils
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
-	"math"
 	"strings"
+	"sync"
 )
 
 // Provides map-like behavior with case-insensitive keys
@@ -69,144 +70,377 @@ func (mm *CIStringMap) Items(callback func(string, string)) {
 	}
 }
 
-// File interface over a part of a file
+// File interface over a part of a file. FilePart satisfies io.Reader,
+// io.Seeker and io.Closer, so it composes with stdlib helpers (io.Copy,
+// bufio.Scanner, gzip.NewReader, ...) without a custom read loop.
 type FilePart struct {
 	fileobj  io.Reader
 	filedata []byte // The contents of the file part are captured on instantiation
 	length   int
-	offset   int
-	buf      []byte
+	offset   int64
+	buf      []byte // unread leftover, shared by Read, ReadLine and GetReader so none of them can drop bytes the others have already pulled off fileobj
+	closed   bool
+
+	section *io.SectionReader // set when backed by NewFilePartAt; enables ReadAt and Seek
+
+	streaming   bool   // set when backed by NewStreamingFilePart
+	bufSize     int    // bufio/ring buffer size for the streaming mode
+	maxLine     int    // max bytes ReadLine will buffer before erroring, streaming mode only
+	ring        []byte // pooled backing array for the streaming mode, released on Close
+	lineScratch []byte // reused read-ahead scratch buffer for ReadLine, allocated lazily
+
+	closer io.Closer // set by NewFilePartFromFs; closed alongside the ring buffer on Close
+}
+
+// defaultStreamBufSize is the default ring-buffer size used by
+// NewStreamingFilePart.
+const defaultStreamBufSize = 64 * 1024
+
+// ErrStreaming is returned by GetData when the FilePart was built with
+// NewStreamingFilePart: a streaming FilePart never buffers the whole
+// record, so there is nothing to hand back.
+var ErrStreaming = errors.New("GetData is unavailable on a streaming FilePart")
+
+// streamBufPool recycles the ring buffers backing streaming FileParts.
+var streamBufPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, 0, defaultStreamBufSize)
+	},
 }
 
 // Creates a new FilePart object
 func NewFilePart(fileobj io.Reader, length int) (*FilePart, error) {
 	// impose an arbitrary 16M limit on file size
-	if length > (2<<23) {
-		length = 2<<23
-	}
-
-	filePart := &FilePart{
-		fileobj: fileobj,
-		length:  length,
-		offset:  0,
-		buf:     []byte{},
+	if length > (2 << 23) {
+		length = 2 << 23
 	}
 
 	// Fix for thread-safety: fully read the contents of the FilePart
 	// initially and put the contents in the buffer. This allows the
 	// contents to be used by a different thread, freeing up the underlying
 	// reader.
-	buf, err := filePart.Read(-1)
-	if err != nil && err.Error() != "EOF" {
-		return nil, err
-	}
+	buf := make([]byte, 0, length)
+	tmp := make([]byte, 4096)
 	for len(buf) < length {
-		tmp, err := filePart.Read(-1)
+		// never ask fileobj for more than this record's remaining bytes, so
+		// whatever follows the record in fileobj is left unread
+		want := length - len(buf)
+		if want > len(tmp) {
+			want = len(tmp)
+		}
+		n, err := fileobj.Read(tmp[:want])
+		if n > 0 {
+			buf = append(buf, tmp[:n]...)
+		}
 		if err != nil {
+			if err != io.EOF {
+				return nil, err
+			}
 			break
 		}
-		buf = append(buf, tmp...)
+	}
+	if len(buf) > length {
+		buf = buf[:length]
 	}
 
-	filePart.offset = 0
-	filePart.filedata = buf
-	filePart.fileobj = bytes.NewBuffer(buf)
-	return filePart, nil
+	return &FilePart{
+		fileobj:  bytes.NewReader(buf),
+		filedata: buf,
+		length:   length,
+	}, nil
 }
 
-// GetData returns the data that was cached from the
-// initial read of the FilePart during instantiation.
-func (fp *FilePart) GetData() []byte {
-	return fp.filedata
+// NewFilePartAt creates a FilePart over the section [off, off+length) of ra
+// without copying the record into memory. Unlike NewFilePart, it never
+// materialises the whole record: Read, ReadLine and GetReader are served
+// directly from an io.SectionReader wrapping ra, and the 16 MiB cap imposed
+// by NewFilePart does not apply. Use this constructor when the backing
+// store is an io.ReaderAt (typically *os.File) and the record may be
+// gigabyte-scale, e.g. media or a warc.gz payload decoded to a temp file.
+func NewFilePartAt(ra io.ReaderAt, off, length int64) *FilePart {
+	section := io.NewSectionReader(ra, off, length)
+	return &FilePart{
+		fileobj: section,
+		length:  int(length),
+		section: section,
+	}
 }
 
-// reads up until the size specified
-func (fp *FilePart) Read(size int) ([]byte, error) {
-	if size == -1 {
-		return fp.read(fp.length)
-	} else {
-		return fp.read(size)
+// ReadAt reads len(p) bytes starting at offset off within this part, for
+// random access into gigabyte-scale payloads. It is only supported for
+// FileParts created with NewFilePartAt.
+func (fp *FilePart) ReadAt(p []byte, off int64) (int, error) {
+	if fp.section == nil {
+		return 0, errors.New("ReadAt is only supported for FileParts created with NewFilePartAt")
 	}
+	return fp.section.ReadAt(p, off)
 }
 
-func (fp *FilePart) read(size int) ([]byte, error) {
-	var content []byte
-	if len(fp.buf) >= size {
-		content = fp.buf[:size]
-		fp.buf = fp.buf[size:]
-	} else {
-		size = int(math.Min(float64(size), float64(fp.length-fp.offset-len(fp.buf))))
-		tmp := make([]byte, size)
-		// if this read doesn't succeed, that's ok
-		// because the buffer might still have content
-		numRead, _ := fp.fileobj.Read(tmp)
-		//		if err != nil {
-		//			return nil, err
-		//		}
-		tmp = tmp[:numRead]
-		content = append(fp.buf, tmp...)
-		fp.buf = []byte{}
-	}
-	fp.offset += len(content)
-	if len(content) == 0 {
-		return nil, errors.New("EOF")
+// NewStreamingFilePart creates a FilePart that reads r on demand through a
+// small, reusable ring buffer instead of copying the whole record into
+// memory like NewFilePart does. bufSize is the ring buffer size in bytes
+// (0 selects the 64 KiB default); ReadLine refuses to buffer a line longer
+// than maxLine bytes (see SetMaxLineSize, default 16x bufSize). Use this
+// for multi-GB payloads (video, PDF, decoded warc.gz) that should flow
+// through a pipeline without ever being buffered whole; GetData is not
+// available in this mode, use GetReader or ReadLine/Iterate instead.
+func NewStreamingFilePart(r io.Reader, length int, bufSize int) *FilePart {
+	if bufSize <= 0 {
+		bufSize = defaultStreamBufSize
+	}
+	ring := streamBufPool.Get().([]byte)
+	if cap(ring) < bufSize {
+		ring = make([]byte, bufSize)
 	} else {
-		return content, nil
+		ring = ring[:bufSize]
+	}
+	return &FilePart{
+		fileobj:   r,
+		length:    length,
+		streaming: true,
+		bufSize:   bufSize,
+		maxLine:   bufSize * 16,
+		ring:      ring,
 	}
+}
 
+// SetMaxLineSize overrides the maximum line length ReadLine will buffer
+// before returning an error. Only meaningful for streaming FileParts.
+func (fp *FilePart) SetMaxLineSize(n int) {
+	fp.maxLine = n
 }
 
-// backs up the reader to the beginning of the content
-func (fp *FilePart) unread(content []byte) {
-	fp.buf = append(content, fp.buf...)
-	fp.offset -= len(content)
+// GetData returns the data that was cached from the initial read of the
+// FilePart during instantiation. Streaming FileParts never cache the whole
+// record, so GetData returns ErrStreaming instead.
+func (fp *FilePart) GetData() ([]byte, error) {
+	if fp.streaming {
+		return nil, ErrStreaming
+	}
+	return fp.filedata, nil
 }
 
-// Reads a single line of content
-func (fp *FilePart) ReadLine() ([]byte, error) {
-	result := []byte{}
-	chunk, err := fp.read(1024)
-	if err != nil {
+// Read implements io.Reader, returning the standard io.EOF rather than a
+// string-compared error. Any bytes left over in fp.buf (e.g. lookahead
+// ReadLine pulled off fileobj but didn't consume) are drained first, so
+// switching from ReadLine to Read mid-record picks up exactly where
+// ReadLine left off. Once fp.buf is empty, buffered and section-backed
+// FileParts read straight through to fileobj; streaming FileParts are
+// served out of the pooled ring buffer so memory use stays bounded by
+// bufSize and, like NewFilePartAt's io.SectionReader, reads never run past
+// length even when fileobj is one record out of a longer, continuously-read
+// stream.
+func (fp *FilePart) Read(p []byte) (int, error) {
+	if fp.closed {
+		return 0, errors.New("FilePart: Read on closed FilePart")
+	}
+	if len(fp.buf) > 0 {
+		n := copy(p, fp.buf)
+		fp.buf = fp.buf[n:]
+		fp.offset += int64(n)
+		return n, nil
+	}
+	if !fp.streaming {
+		n, err := fp.fileobj.Read(p)
+		fp.offset += int64(n)
+		return n, err
+	}
+	remaining := fp.streamRemaining()
+	if remaining <= 0 {
+		return 0, io.EOF
+	}
+	want := int64(len(fp.ring))
+	if remaining < want {
+		want = remaining
+	}
+	n, err := fp.fileobj.Read(fp.ring[:want])
+	if n == 0 {
+		return 0, err
+	}
+	fp.buf = fp.ring[:n]
+	n = copy(p, fp.buf)
+	fp.buf = fp.buf[n:]
+	fp.offset += int64(n)
+	return n, nil
+}
+
+// streamRemaining returns how many bytes of this record a streaming
+// FilePart still has left to deliver: length minus what Read has already
+// handed out (offset) minus what's sitting in the lookahead buffer waiting
+// to be handed out (buf). Read, readRaw and GetReader all cap against this
+// so none of them can run past this record's end into whatever follows
+// fileobj in a longer, continuously-read stream.
+func (fp *FilePart) streamRemaining() int64 {
+	remaining := int64(fp.length) - fp.offset - int64(len(fp.buf))
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining
+}
+
+// readRaw pulls more bytes straight from the underlying source, bounded by
+// length for streaming FileParts. Unlike Read, it does not touch fp.buf or
+// fp.offset: it exists so ReadLine can grow its own lookahead buffer without
+// double-accounting bytes that are buffered but not yet handed to a caller.
+func (fp *FilePart) readRaw(p []byte) (int, error) {
+	if !fp.streaming {
+		return fp.fileobj.Read(p)
+	}
+	remaining := fp.streamRemaining()
+	if remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	return fp.fileobj.Read(p)
+}
+
+// ReadChunk reads up to size bytes (or the remaining length if size is -1)
+// and returns them as a new []byte.
+//
+// ReadChunk is a rename of the old Read(size int) ([]byte, error) method:
+// Go has no overloading, so the old signature couldn't coexist with the
+// io.Reader-shaped Read(p []byte) added alongside it. Callers using the old
+// name need to update to ReadChunk, there is no compatibility shim.
+func (fp *FilePart) ReadChunk(size int) ([]byte, error) {
+	if size == -1 {
+		size = fp.length
+	}
+	p := make([]byte, size)
+	n, err := fp.Read(p)
+	if n == 0 {
 		return nil, err
 	}
+	return p[:n], nil
+}
 
-	for findNewline(chunk) == -1 {
-		result = append(result, chunk...)
-		chunk, err = fp.read(1024)
-		if err != nil && err.Error() == "EOF" {
-			chunk = []byte{}
-			break
+// Seek implements io.Seeker. It is backed by the cached bytes (via
+// bytes.Reader) for FileParts created with NewFilePart, or by the
+// underlying io.SectionReader for FileParts created with NewFilePartAt.
+// Streaming FileParts read forward only and are not seekable.
+func (fp *FilePart) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := fp.fileobj.(io.Seeker)
+	if fp.streaming || !ok {
+		return 0, errors.New("FilePart: Seek is not supported on a streaming FilePart")
+	}
+	if whence == io.SeekCurrent {
+		// fileobj sits len(fp.buf) bytes ahead of what callers have been
+		// handed, so resolve relative seeks against fp.offset instead
+		offset += fp.offset
+		whence = io.SeekStart
+	}
+	abs, err := seeker.Seek(offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	fp.buf = nil
+	fp.offset = abs
+	return abs, nil
+}
+
+// Close implements io.Closer. It returns the pooled ring buffer used by
+// streaming FileParts (a no-op otherwise), closes the underlying File when
+// the FilePart came from NewFilePartFromFs, and marks the FilePart unusable.
+func (fp *FilePart) Close() error {
+	if fp.closed {
+		return nil
+	}
+	fp.closed = true
+	if fp.streaming && fp.ring != nil {
+		streamBufPool.Put(fp.ring[:0])
+		fp.ring = nil
+	}
+	if fp.closer != nil {
+		return fp.closer.Close()
+	}
+	return nil
+}
+
+// ReadLine reads a single line (including the trailing newline, if any),
+// returning io.EOF once nothing is left to read. It grows fp.buf directly
+// rather than wrapping fp in its own bufio.Reader, so the lookahead bytes it
+// pulls off fileobj stay visible to Read and GetReader: callers can freely
+// switch from ReadLine to Read/GetReader mid-record (the standard WARC
+// pattern of reading header lines, then consuming the rest of the payload
+// as raw bytes) without losing anything already buffered.
+func (fp *FilePart) ReadLine() ([]byte, error) {
+	if fp.closed {
+		return nil, errors.New("FilePart: ReadLine on closed FilePart")
+	}
+	if fp.lineScratch == nil {
+		size := fp.bufSize
+		if size <= 0 {
+			size = defaultStreamBufSize
 		}
+		fp.lineScratch = make([]byte, size)
 	}
-	i := findNewline(chunk)
-	if i != -1 {
-		fp.unread(chunk[i+1:])
-		chunk = chunk[:i+1]
+	for {
+		if i := bytes.IndexByte(fp.buf, '\n'); i >= 0 {
+			if fp.streaming && i+1 > fp.maxLine {
+				return nil, fmt.Errorf("FilePart.ReadLine: line exceeds max line size of %d bytes", fp.maxLine)
+			}
+			line := append([]byte(nil), fp.buf[:i+1]...)
+			fp.buf = fp.buf[i+1:]
+			fp.offset += int64(len(line))
+			return line, nil
+		}
+		if fp.streaming && len(fp.buf) > fp.maxLine {
+			return nil, fmt.Errorf("FilePart.ReadLine: line exceeds max line size of %d bytes", fp.maxLine)
+		}
+		n, err := fp.readRaw(fp.lineScratch)
+		if n > 0 {
+			fp.buf = append(fp.buf, fp.lineScratch[:n]...)
+		}
+		if err != nil {
+			if err == io.EOF {
+				if len(fp.buf) == 0 {
+					return nil, io.EOF
+				}
+				line := fp.buf
+				fp.buf = nil
+				fp.offset += int64(len(line))
+				return line, nil
+			}
+			return nil, err
+		}
 	}
-	result = append(result, chunk...)
-	return result, nil
 }
 
 // Iterates and invokes the callback function for each line
 func (fp *FilePart) Iterate(callback func([]byte)) {
-	line, err := fp.ReadLine()
-	if err != nil {
-		return
-	}
-	for err == nil {
-		callback(line)
-		line, err = fp.ReadLine()
+	for {
+		line, err := fp.ReadLine()
+		if len(line) > 0 {
+			callback(line)
+		}
+		if err != nil {
+			return
+		}
 	}
 }
 
+// GetReader returns an io.Reader over whatever content remains. This
+// includes any bytes a prior Read or ReadLine already pulled off fileobj
+// but didn't hand back to its caller, so interleaving ReadLine/Read with
+// GetReader doesn't silently drop them. For a streaming FilePart the result
+// is also capped at length (like Read itself) so it can't run past this
+// record's end into whatever follows fileobj in a longer, continuously-read
+// stream.
 func (fp *FilePart) GetReader() io.Reader {
-	return fp.fileobj
+	rest := io.Reader(fp.fileobj)
+	if fp.streaming {
+		rest = io.LimitReader(fp.fileobj, fp.streamRemaining())
+	}
+	if len(fp.buf) == 0 {
+		return rest
+	}
+	leftover := make([]byte, len(fp.buf))
+	copy(leftover, fp.buf)
+	fp.buf = fp.buf[:0]
+	return io.MultiReader(bytes.NewReader(leftover), rest)
 }
 
 func (fp *FilePart) GetLength() int {
 	return fp.length
 }
-
-func findNewline(chunk []byte) int {
-	return bytes.IndexByte(chunk, '\n')
-}
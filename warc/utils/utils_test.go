@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+type errReader struct {
+	n   int
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	if r.n > 0 {
+		m := r.n
+		if m > len(p) {
+			m = len(p)
+		}
+		for i := 0; i < m; i++ {
+			p[i] = 'a'
+		}
+		r.n -= m
+		return m, nil
+	}
+	return 0, r.err
+}
+
+func TestNewFilePartPropagatesReadError(t *testing.T) {
+	wantErr := errors.New("boom")
+	_, err := NewFilePart(&errReader{n: 2, err: wantErr}, 10)
+	if err != wantErr {
+		t.Fatalf("expected %v, got %v", wantErr, err)
+	}
+}
+
+func TestNewStreamingFilePartBoundsLength(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 40)
+	fp := NewStreamingFilePart(bytes.NewReader(data), 18, 8)
+	defer fp.Close()
+
+	got, err := io.ReadAll(fp)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if len(got) != 18 {
+		t.Fatalf("expected 18 bytes, got %d (streaming FilePart read past length)", len(got))
+	}
+}
+
+func TestFilePartGetReaderAfterReadKeepsBufferedBytes(t *testing.T) {
+	data := []byte("0123456789ABCDEFGHIJ") // 20 bytes
+	fp := NewStreamingFilePart(bytes.NewReader(data), len(data), 8)
+	defer fp.Close()
+
+	first := make([]byte, 5)
+	if _, err := io.ReadFull(fp, first); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+
+	rest, err := io.ReadAll(fp.GetReader())
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if got := string(first) + string(rest); got != string(data) {
+		t.Fatalf("expected %q, got %q (bytes vanished between Read and GetReader)", data, got)
+	}
+}
+
+func TestFilePartReadLineThenReadKeepsBufferedBytes(t *testing.T) {
+	data := []byte("line1\nline2\nline3\n")
+
+	fp, err := NewFilePart(bytes.NewReader(data), len(data))
+	if err != nil {
+		t.Fatalf("NewFilePart: %v", err)
+	}
+	defer fp.Close()
+
+	if _, err := fp.ReadLine(); err != nil {
+		t.Fatalf("ReadLine: %v", err)
+	}
+	rest, err := io.ReadAll(fp)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(rest) != "line2\nline3\n" {
+		t.Fatalf("expected %q, got %q (bytes lost switching from ReadLine to Read)", "line2\nline3\n", rest)
+	}
+}
+
+func TestFilePartReadLineThenGetReaderKeepsBufferedBytes(t *testing.T) {
+	data := []byte("line1\nline2\nline3\n")
+	stream := bytes.NewReader(data)
+	fp := NewStreamingFilePart(stream, len(data), 8)
+	defer fp.Close()
+
+	if _, err := fp.ReadLine(); err != nil {
+		t.Fatalf("ReadLine: %v", err)
+	}
+	rest, err := io.ReadAll(fp.GetReader())
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(rest) != "line2\nline3\n" {
+		t.Fatalf("expected %q, got %q (bytes lost switching from ReadLine to GetReader)", "line2\nline3\n", rest)
+	}
+}
+
+func TestFilePartGetReaderDoesNotReadPastLength(t *testing.T) {
+	record := bytes.Repeat([]byte("r"), 100)
+	nextRecord := bytes.Repeat([]byte("n"), 50)
+	stream := bytes.NewReader(append(append([]byte{}, record...), nextRecord...))
+
+	fp := NewStreamingFilePart(stream, len(record), 64)
+	defer fp.Close()
+
+	first := make([]byte, 50)
+	if _, err := io.ReadFull(fp, first); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+
+	rest, err := io.ReadAll(fp.GetReader())
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	got := append(append([]byte{}, first...), rest...)
+	if len(got) != len(record) {
+		t.Fatalf("expected %d bytes, got %d (GetReader read into the next record)", len(record), len(got))
+	}
+	if !bytes.Equal(got, record) {
+		t.Fatalf("expected %q, got %q", record, got)
+	}
+}